@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
+	"github.com/flynn/flynn/host/resource"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+// CapacityRepo tracks how much of the cluster's configured resource budget
+// is reserved by releases the deployer has scaled up, keyed by
+// (release_id, job_type) so a reservation persists for as long as those
+// processes keep running, not just for the deployment that created them.
+// It stands in for real per-host bin-packing (which would need the
+// controller to track live flynn-host state) with a single cluster-wide
+// budget, configured via the CLUSTER_CAPACITY_* environment variables.
+type CapacityRepo struct {
+	db    *postgres.DB
+	total map[resource.Type]int64
+}
+
+// NewCapacityRepo returns a CapacityRepo backed by db, with its total
+// budget read from the environment (falling back to generous defaults so
+// an unconfigured cluster doesn't spuriously block deploys).
+func NewCapacityRepo(db *postgres.DB) *CapacityRepo {
+	return &CapacityRepo{
+		db: db,
+		total: map[resource.Type]int64{
+			resource.TypeMemory: envInt64("CLUSTER_CAPACITY_MEMORY", 64*1024*resource.MB),
+			resource.TypeCPU:    envInt64("CLUSTER_CAPACITY_CPU", 32),
+			resource.TypeMaxFD:  envInt64("CLUSTER_CAPACITY_MAX_FD", 1024*1024),
+		},
+	}
+}
+
+func envInt64(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// RegisterCapacityRoutes registers the endpoints backing
+// controller.Client's HasCapacity and ReleaseCapacity, used by
+// deployer/strategies' waitForCapacity and releaseCapacity.
+func RegisterCapacityRoutes(repo *CapacityRepo, r *httprouter.Router) {
+	r.POST("/capacity", repo.CheckHandler)
+	r.POST("/capacity/release", repo.ReleaseHandler)
+}
+
+type capacityCheckRequest struct {
+	ReleaseID string             `json:"release_id"`
+	Type      string             `json:"type"`
+	Count     int                `json:"count"`
+	Resources resource.Resources `json:"resources"`
+}
+
+type capacityCheckResponse struct {
+	HasCapacity bool `json:"has_capacity"`
+}
+
+// CheckHandler handles POST /capacity: if reserving req.Count more
+// instances of req.Type from req.ReleaseID with req.Resources would fit
+// within the cluster's configured budget alongside every other active
+// reservation, it records the reservation (adding to any existing one for
+// the same release and type) and reports has_capacity: true; otherwise it
+// leaves existing reservations untouched and reports has_capacity: false.
+func (c *CapacityRepo) CheckHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var body capacityCheckRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	ok, err := c.reserve(body.ReleaseID, body.Type, body.Count, body.Resources)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, capacityCheckResponse{HasCapacity: ok})
+}
+
+type capacityReleaseRequest struct {
+	ReleaseID string `json:"release_id"`
+	Type      string `json:"type"`
+	Count     int    `json:"count"`
+}
+
+// ReleaseHandler handles POST /capacity/release, freeing req.Count
+// instances of req.Type previously reserved against req.ReleaseID.
+// Releasing more than was reserved (or a release/type pair that was never
+// reserved) is not an error, since a reservation can't go below zero.
+func (c *CapacityRepo) ReleaseHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var body capacityReleaseRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if err := c.release(body.ReleaseID, body.Type, body.Count); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// reserve reports whether n more instances of typ from releaseID
+// requesting res would fit in the cluster's remaining budget, and if so
+// persists the reservation, folding it into any existing reservation for
+// the same release and type so there's always at most one row per
+// (release_id, job_type) for release to adjust.
+func (c *CapacityRepo) reserve(releaseID, typ string, n int, res resource.Resources) (bool, error) {
+	res.SetDefaults()
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	used, err := c.usedResources(tx)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	for rtype, spec := range res {
+		if used[rtype]+spec.Request*int64(n) > c.total[rtype] {
+			return false, tx.Rollback()
+		}
+	}
+
+	resourcesJSON, err := json.Marshal(res)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	var existing int
+	err = tx.QueryRow(
+		"SELECT count FROM capacity_reservations WHERE release_id = $1 AND job_type = $2 FOR UPDATE",
+		releaseID, typ,
+	).Scan(&existing)
+	switch err {
+	case nil:
+		_, err = tx.Exec(
+			"UPDATE capacity_reservations SET count = count + $3, resources = $4 WHERE release_id = $1 AND job_type = $2",
+			releaseID, typ, n, resourcesJSON,
+		)
+	case sql.ErrNoRows:
+		_, err = tx.Exec(
+			"INSERT INTO capacity_reservations (release_id, job_type, count, resources) VALUES ($1, $2, $3, $4)",
+			releaseID, typ, n, resourcesJSON,
+		)
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// release frees n instances of typ from releaseID's reservation, deleting
+// it entirely once its count reaches zero (or below, which is treated the
+// same as zero).
+func (c *CapacityRepo) release(releaseID, typ string, n int) error {
+	_, err := c.db.Exec(
+		`UPDATE capacity_reservations SET count = count - $3
+		WHERE release_id = $1 AND job_type = $2`,
+		releaseID, typ, n,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec("DELETE FROM capacity_reservations WHERE release_id = $1 AND job_type = $2 AND count <= 0", releaseID, typ)
+	return err
+}
+
+// queryer is satisfied by both *postgres.DB and the transaction reserve
+// runs in, so usedResources can read a consistent view of the reservation
+// table during a reserve without a separate non-transactional code path.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// usedResources sums the per-type resource requests across every active
+// reservation visible to q.
+func (c *CapacityRepo) usedResources(q queryer) (map[resource.Type]int64, error) {
+	rows, err := q.Query("SELECT count, resources FROM capacity_reservations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	used := make(map[resource.Type]int64)
+	for rows.Next() {
+		var count int
+		var resourcesJSON []byte
+		if err := rows.Scan(&count, &resourcesJSON); err != nil {
+			return nil, err
+		}
+		var res resource.Resources
+		if err := json.Unmarshal(resourcesJSON, &res); err != nil {
+			return nil, err
+		}
+		for rtype, spec := range res {
+			used[rtype] += spec.Request * int64(count)
+		}
+	}
+	return used, rows.Err()
+}
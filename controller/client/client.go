@@ -0,0 +1,152 @@
+// Package controller is a client for the controller API, used by the
+// deployer to drive formation changes and watch job events while running a
+// deployment strategy.
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/resource"
+)
+
+// Client is a client for the controller API.
+type Client struct {
+	URL  string
+	HTTP *http.Client
+}
+
+// NewClient returns a Client talking to the controller at url.
+func NewClient(url string) *Client {
+	return &Client{URL: url, HTTP: http.DefaultClient}
+}
+
+func (c *Client) get(path string, out interface{}) error {
+	res, err := c.HTTP.Get(c.URL + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("controller: unexpected status %d from %s", res.StatusCode, path)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (c *Client) post(path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	res, err := c.HTTP.Post(c.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("controller: unexpected status %d from %s", res.StatusCode, path)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// GetFormation returns the current desired process counts for releaseID.
+func (c *Client) GetFormation(appID, releaseID string) (*ct.Formation, error) {
+	f := &ct.Formation{}
+	if err := c.get(fmt.Sprintf("/apps/%s/formations/%s", appID, releaseID), f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// PutFormation sets the desired process counts for f.ReleaseID.
+func (c *Client) PutFormation(f *ct.Formation) error {
+	return c.post(fmt.Sprintf("/apps/%s/formations/%s", f.AppID, f.ReleaseID), f, nil)
+}
+
+// Stream is a subscription to a stream of events from the controller;
+// Close unsubscribes and stops delivery to the output channel.
+type Stream interface {
+	Close()
+}
+
+type jobEventStream struct {
+	body    interface{ Close() error }
+	closeCh chan struct{}
+}
+
+func (s *jobEventStream) Close() {
+	close(s.closeCh)
+	s.body.Close()
+}
+
+// StreamJobEvents streams job state changes for appID since sinceID to
+// output until the returned Stream is closed.
+func (c *Client) StreamJobEvents(appID string, sinceID int64, output chan<- *ct.JobEvent) (Stream, error) {
+	res, err := c.HTTP.Get(fmt.Sprintf("%s/apps/%s/jobs/events?since=%d", c.URL, appID, sinceID))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, fmt.Errorf("controller: unexpected status %d streaming job events", res.StatusCode)
+	}
+
+	stream := &jobEventStream{body: res.Body, closeCh: make(chan struct{})}
+	go func() {
+		dec := json.NewDecoder(res.Body)
+		for {
+			event := &ct.JobEvent{}
+			if err := dec.Decode(event); err != nil {
+				return
+			}
+			select {
+			case output <- event:
+			case <-stream.closeCh:
+				return
+			}
+		}
+	}()
+	return stream, nil
+}
+
+// HasCapacity reports whether the cluster has enough free capacity across
+// its hosts to run n additional jobs of type typ from releaseID requesting
+// res, and if so reserves it against (releaseID, typ). The reservation
+// persists until ReleaseCapacity is called with the same releaseID, typ
+// and n, which may happen much later, once releaseID stops being the new
+// release and becomes the old one a later deployment replaces in turn.
+func (c *Client) HasCapacity(releaseID, typ string, n int, res resource.Resources) (bool, error) {
+	var result struct {
+		HasCapacity bool `json:"has_capacity"`
+	}
+	req := struct {
+		ReleaseID string             `json:"release_id"`
+		Type      string             `json:"type"`
+		Count     int                `json:"count"`
+		Resources resource.Resources `json:"resources"`
+	}{releaseID, typ, n, res}
+	if err := c.post("/capacity", req, &result); err != nil {
+		return false, err
+	}
+	return result.HasCapacity, nil
+}
+
+// ReleaseCapacity releases n instances of typ from a reservation
+// previously made against releaseID by HasCapacity, once they've actually
+// stopped. Releasing more than was reserved (or a releaseID/typ pair that
+// was never reserved, e.g. because it predates capacity tracking) is not
+// an error: the reservation simply can't go below zero.
+func (c *Client) ReleaseCapacity(releaseID, typ string, n int) error {
+	req := struct {
+		ReleaseID string `json:"release_id"`
+		Type      string `json:"type"`
+		Count     int    `json:"count"`
+	}{releaseID, typ, n}
+	return c.post("/capacity/release", req, nil)
+}
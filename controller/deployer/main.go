@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/deployer/types"
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+func main() {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatalf("deployer: failed to connect to database: %s", err)
+	}
+	if err := migrateDB(db); err != nil {
+		log.Fatalf("deployer: failed to migrate database: %s", err)
+	}
+	pdb := postgres.New(db, nil)
+
+	client := controller.NewClient(os.Getenv("CONTROLLER_URL"))
+	events := make(chan deployer.DeploymentEvent)
+	go func() {
+		for e := range events {
+			log.Printf("deployer: deployment %s: %s", e.DeploymentID, e.Status)
+		}
+	}()
+
+	Run(pdb, client, events, nil)
+}
@@ -21,5 +21,43 @@ func migrateDB(db *sql.DB) error {
     CONSTRAINT que_jobs_pkey PRIMARY KEY (queue, priority, run_at, job_id))`,
 		`COMMENT ON TABLE que_jobs IS '3'`,
 	)
+	m.Add(2,
+		`CREATE TABLE app_webhooks (
+    webhook_id  uuid        NOT NULL DEFAULT gen_random_uuid() PRIMARY KEY,
+    app_id      uuid        NOT NULL,
+    url         text        NOT NULL,
+    secret      text        NOT NULL,
+    created_at  timestamptz NOT NULL DEFAULT now())`,
+		`CREATE TABLE deployment_event_deliveries (
+    delivery_id  uuid        NOT NULL DEFAULT gen_random_uuid() PRIMARY KEY,
+    webhook_id   uuid        NOT NULL REFERENCES app_webhooks (webhook_id),
+    event_id     bigint      NOT NULL,
+    created_at   timestamptz NOT NULL DEFAULT now(),
+    delivered_at timestamptz)`,
+	)
+	m.Add(3,
+		`ALTER TABLE deployments ADD COLUMN priority smallint NOT NULL DEFAULT 100`,
+		`ALTER TABLE deployments ADD COLUMN lease_expires_at timestamptz`,
+		`ALTER TABLE deployments ADD COLUMN cancel_requested boolean NOT NULL DEFAULT false`,
+	)
+	m.Add(4,
+		`ALTER TABLE deployments ADD COLUMN canary_percent smallint NOT NULL DEFAULT 0`,
+		`ALTER TABLE deployments ADD COLUMN bake_duration_ms bigint NOT NULL DEFAULT 0`,
+		`ALTER TABLE deployments ADD COLUMN surge_batch smallint NOT NULL DEFAULT 0`,
+	)
+	m.Add(5,
+		`ALTER TABLE deployments ADD COLUMN resources json`,
+		`CREATE TABLE capacity_reservations (
+    release_id  uuid        NOT NULL,
+    job_type    text        NOT NULL,
+    count       integer     NOT NULL,
+    resources   json        NOT NULL,
+    created_at  timestamptz NOT NULL DEFAULT now(),
+
+    CONSTRAINT capacity_reservations_pkey PRIMARY KEY (release_id, job_type))`,
+	)
+	m.Add(6,
+		`ALTER TABLE deployments ADD COLUMN stuck_at timestamptz`,
+	)
 	return m.Migrate(db)
 }
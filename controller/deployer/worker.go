@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/deployer/strategies"
+	"github.com/flynn/flynn/deployer/types"
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+// leaseDuration is how long a claimed deployment's lease is valid before
+// another deployer instance is allowed to reclaim it.
+const leaseDuration = 30 * time.Second
+
+// leaseRenewInterval is how often a worker renews the lease on the
+// deployment it is currently running.
+const leaseRenewInterval = 10 * time.Second
+
+// pollInterval is how often Run checks for a claimable deployment when
+// none was available (or claiming one failed) last time around.
+const pollInterval = 2 * time.Second
+
+// Run is the worker's main loop: it repeatedly claims the
+// highest-priority runnable deployment and runs it to completion,
+// polling every pollInterval when there's nothing to claim. It blocks
+// until stop is closed.
+func Run(db *postgres.DB, client *controller.Client, events chan<- deployer.DeploymentEvent, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		d, err := claimDeployment(db)
+		if err == sql.ErrNoRows {
+			time.Sleep(pollInterval)
+			continue
+		}
+		if err != nil {
+			log.Printf("deployer: failed to claim a deployment: %s", err)
+			time.Sleep(pollInterval)
+			continue
+		}
+
+		if err := runDeployment(db, client, d, events); err != nil {
+			log.Printf("deployer: deployment %s failed: %s", d.ID, err)
+		}
+	}
+}
+
+// claimDeployment claims the highest-priority runnable deployment using
+// SELECT ... FOR UPDATE SKIP LOCKED, so any number of deployer instances can
+// each run their own worker loop against the same queue without two of them
+// executing the same deployment at once. It returns sql.ErrNoRows if there
+// is nothing to claim right now.
+func claimDeployment(db *postgres.DB) (*ct.Deployment, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	row := tx.QueryRow(`
+SELECT deployment_id, app_id, old_release_id, new_release_id, strategy, priority,
+       canary_percent, bake_duration_ms, surge_batch, resources, lease_expires_at
+FROM deployments
+WHERE finished_at IS NULL
+  AND cancel_requested = false
+  AND (lease_expires_at IS NULL OR lease_expires_at < now())
+ORDER BY priority ASC, created_at ASC
+FOR UPDATE SKIP LOCKED
+LIMIT 1`)
+
+	var bakeDurationMS int64
+	var resourcesJSON []byte
+	var leaseExpiresAt *time.Time
+	d := &ct.Deployment{}
+	if err := row.Scan(&d.ID, &d.AppID, &d.OldReleaseID, &d.NewReleaseID, &d.Strategy, &d.Priority,
+		&d.CanaryPercent, &bakeDurationMS, &d.SurgeBatch, &resourcesJSON, &leaseExpiresAt); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	d.BakeDuration = time.Duration(bakeDurationMS) * time.Millisecond
+	if len(resourcesJSON) > 0 {
+		if err := json.Unmarshal(resourcesJSON, &d.Resources); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	// leaseExpiresAt is only non-nil here if a previous worker claimed this
+	// deployment and its lease then expired without it finishing, meaning
+	// that worker died mid-run or its run returned an error -- as opposed to
+	// this being the deployment's first claim, when lease_expires_at is
+	// still NULL. Mark it stuck so an operator can see it stalled and was
+	// retried.
+	if leaseExpiresAt != nil {
+		log.Printf("deployer: reclaiming deployment %s, its lease expired at %s", d.ID, leaseExpiresAt)
+		if _, err := tx.Exec("UPDATE deployments SET stuck_at = now() WHERE deployment_id = $1", d.ID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE deployments SET lease_expires_at = now() + $1 * interval '1 second' WHERE deployment_id = $2", leaseDuration.Seconds(), d.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return d, tx.Commit()
+}
+
+// renewLease extends id's lease every leaseRenewInterval until done is
+// closed, so a worker that's still alive and making progress is never
+// mistaken for stuck. If the process dies, the lease simply expires and
+// claimDeployment lets another worker pick the deployment back up.
+func renewLease(db *postgres.DB, id string, done <-chan struct{}) {
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			db.Exec("UPDATE deployments SET lease_expires_at = now() + $1 * interval '1 second' WHERE deployment_id = $2", leaseDuration.Seconds(), id)
+		}
+	}
+}
+
+// cancelRequested reports whether id's deployment has had cancellation
+// requested via DeploymentRepo.Cancel.
+func cancelRequested(db *postgres.DB, id string) bool {
+	var cancelled bool
+	db.QueryRow("SELECT cancel_requested FROM deployments WHERE deployment_id = $1", id).Scan(&cancelled)
+	return cancelled
+}
+
+// runDeployment runs d's strategy to completion, renewing its lease in the
+// background and letting the strategy poll for cancellation between
+// formation changes, then marks it finished.
+func runDeployment(db *postgres.DB, client *controller.Client, d *ct.Deployment, events chan<- deployer.DeploymentEvent) error {
+	done := make(chan struct{})
+	go renewLease(db, d.ID, done)
+	defer close(done)
+
+	fn, err := strategy.Get(d.Strategy)
+	if err != nil {
+		return err
+	}
+
+	sd := &deployer.Deployment{
+		ID:            d.ID,
+		AppID:         d.AppID,
+		OldReleaseID:  d.OldReleaseID,
+		NewReleaseID:  d.NewReleaseID,
+		CanaryPercent: d.CanaryPercent,
+		BakeDuration:  d.BakeDuration,
+		SurgeBatch:    d.SurgeBatch,
+		Resources:     d.Resources,
+		Cancelled: func() bool {
+			return cancelRequested(db, d.ID)
+		},
+	}
+
+	if err := fn(client, sd, events); err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE deployments SET finished_at = now() WHERE deployment_id = $1", d.ID)
+	return err
+}
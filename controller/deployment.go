@@ -2,28 +2,45 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
 
-	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/bgentry/que-go"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
-	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/jackc/pgx"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/websocket"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/random"
 )
 
 type DeploymentRepo struct {
 	db *postgres.DB
-	q  *que.Client
 }
 
-func NewDeploymentRepo(db *postgres.DB, pgxpool *pgx.ConnPool) *DeploymentRepo {
-	q := que.NewClient(pgxpool)
-	return &DeploymentRepo{db: db, q: q}
+// NewDeploymentRepo returns a DeploymentRepo backed by db. Deployments it
+// creates are picked up by controller/deployer's worker loop, which polls
+// the deployments table directly rather than being dispatched a job.
+func NewDeploymentRepo(db *postgres.DB) *DeploymentRepo {
+	repo := &DeploymentRepo{db: db}
+	if err := repo.resumePendingDeliveries(); err != nil {
+		log.Printf("controller: failed to resume pending webhook deliveries: %s", err)
+	}
+	return repo
+}
+
+// deploymentPriority picks a que_jobs-style priority (lower runs first) for
+// a deployment based on its strategy: canary deployments bake in the
+// background between formation changes, so they can afford to queue behind
+// plain one-by-one rollouts without delaying the operator.
+func deploymentPriority(strategy string) int16 {
+	if strategy == "canary" {
+		return 150
+	}
+	return 100
 }
 
 func (r *DeploymentRepo) Add(data interface{}) error {
@@ -31,36 +48,80 @@ func (r *DeploymentRepo) Add(data interface{}) error {
 	if deployment.ID == "" {
 		deployment.ID = random.UUID()
 	}
-	query := "INSERT INTO deployments (deployment_id, app_id, old_release_id, new_release_id, strategy) VALUES ($1, $2, $3, $4, $5) RETURNING created_at"
-	if err := r.db.QueryRow(query, deployment.ID, deployment.AppID, deployment.OldReleaseID, deployment.NewReleaseID, deployment.Strategy).Scan(&deployment.CreatedAt); err != nil {
+	deployment.Priority = deploymentPriority(deployment.Strategy)
+	resourcesJSON, err := json.Marshal(deployment.Resources)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO deployments
+		(deployment_id, app_id, old_release_id, new_release_id, strategy, priority, canary_percent, bake_duration_ms, surge_batch, resources)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING created_at`
+	if err := r.db.QueryRow(query,
+		deployment.ID, deployment.AppID, deployment.OldReleaseID, deployment.NewReleaseID, deployment.Strategy, deployment.Priority,
+		deployment.CanaryPercent, deployment.BakeDuration/time.Millisecond, deployment.SurgeBatch, resourcesJSON,
+	).Scan(&deployment.CreatedAt); err != nil {
 		return err
 	}
 	deployment.ID = postgres.CleanUUID(deployment.ID)
 	deployment.OldReleaseID = postgres.CleanUUID(deployment.OldReleaseID)
 	deployment.NewReleaseID = postgres.CleanUUID(deployment.NewReleaseID)
 
-	args, err := json.Marshal(ct.DeployID{ID: deployment.ID})
+	// No explicit dispatch needed: the deployment is now claimed by
+	// controller/deployer's worker loop, which polls for runnable rows
+	// directly (see claimDeployment) instead of being handed que_jobs.
+	r.watchWebhooks(deployment)
+	return nil
+}
+
+// Cancel flags id's deployment for cancellation. The worker running it polls
+// this flag between PutFormation calls (see deployer/strategies) and aborts
+// the deployment cleanly the next time it checks.
+func (r *DeploymentRepo) Cancel(id string) error {
+	res, err := r.db.Exec("UPDATE deployments SET cancel_requested = true WHERE deployment_id = $1 AND finished_at IS NULL", id)
 	if err != nil {
 		return err
 	}
-	if err := r.q.Enqueue(&que.Job{
-		Type: "Deployment",
-		Args: args,
-	}); err != nil {
+	n, err := res.RowsAffected()
+	if err != nil {
 		return err
 	}
+	if n == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
 
+// RegisterDeploymentRoutes registers the deployment cancellation endpoint.
+func RegisterDeploymentRoutes(repo *DeploymentRepo, r *httprouter.Router) {
+	r.POST("/deployments/:id/cancel", repo.CancelHandler)
+}
+
+// CancelHandler handles POST /deployments/:id/cancel, flagging the named
+// deployment for cancellation.
+func (r *DeploymentRepo) CancelHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if err := r.Cancel(ps.ByName("id")); err != nil {
+		if err == ErrNotFound {
+			httphelper.Error(w, httphelper.JSONError{
+				Code:    httphelper.ObjectNotFoundError,
+				Message: "deployment not found or already finished",
+			})
+			return
+		}
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
 func (r *DeploymentRepo) Get(id string) (*ct.Deployment, error) {
-	query := "SELECT deployment_id, app_id, old_release_id, new_release_id, strategy, created_at, finished_at FROM deployments WHERE deployment_id = $1"
+	query := "SELECT deployment_id, app_id, old_release_id, new_release_id, strategy, created_at, finished_at, stuck_at FROM deployments WHERE deployment_id = $1"
 	row := r.db.QueryRow(query, id)
 	return scanDeployment(row)
 }
 
 func scanDeployment(s postgres.Scanner) (*ct.Deployment, error) {
 	d := &ct.Deployment{}
-	err := s.Scan(&d.ID, &d.AppID, &d.OldReleaseID, &d.NewReleaseID, &d.Strategy, &d.CreatedAt, &d.FinishedAt)
+	err := s.Scan(&d.ID, &d.AppID, &d.OldReleaseID, &d.NewReleaseID, &d.Strategy, &d.CreatedAt, &d.FinishedAt, &d.StuckAt)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
@@ -72,39 +133,33 @@ func scanDeployment(s postgres.Scanner) (*ct.Deployment, error) {
 
 // Deployment events
 
-// TODO: share with controller streamJobs
+// streamDeploymentEvents streams deploymentID's events to w as
+// server-sent events, the transport used by the web dashboard.
 func streamDeploymentEvents(deploymentID string, w http.ResponseWriter, repo *DeploymentRepo) {
-	var err error
-	defer func() {
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-		}
-	}()
-
-	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
-
-	sendKeepAlive := func() error {
-		if _, err := w.Write([]byte(":\n")); err != nil {
-			return err
-		}
-		w.(http.Flusher).Flush()
-		return nil
+	sink := newSSESink(w)
+	closed := w.(http.CloseNotifier).CloseNotify()
+	if err := runEventSink(deploymentID, repo, sink, closed); err != nil {
+		http.Error(w, err.Error(), 500)
 	}
+}
 
-	sendDeploymentEvent := func(e *ct.DeploymentEvent) error {
-		if _, err := fmt.Fprintf(w, "id: %d\ndata: ", e.ID); err != nil {
-			return err
-		}
-		if err := json.NewEncoder(w).Encode(e); err != nil {
-			return err
-		}
-		if _, err := w.Write([]byte("\n")); err != nil {
-			return err
-		}
-		w.(http.Flusher).Flush()
-		return nil
-	}
+// streamDeploymentEventsWS streams deploymentID's events as JSON frames over
+// conn, a WebSocket connection negotiated via the standard Upgrade
+// handshake. Unlike SSE it needs no keep-alive framing, since WebSocket pings
+// are handled by the underlying connection.
+func streamDeploymentEventsWS(deploymentID string, conn *websocket.Conn, repo *DeploymentRepo) error {
+	sink := newWSSink(conn)
+	defer sink.Close()
+	return runEventSink(deploymentID, repo, sink, nil)
+}
 
+// runEventSink replays deploymentID's past events to sink and then fans out
+// new ones as they're written, until closed fires, the sink returns an
+// error, or the deployment's listener is disconnected. closed may be nil,
+// meaning the sink has no independent notion of client disconnection.
+//
+// TODO: share with controller streamJobs
+func runEventSink(deploymentID string, repo *DeploymentRepo, sink DeploymentEventSink, closed <-chan bool) (err error) {
 	connected := make(chan struct{})
 	done := make(chan struct{})
 	listenEvent := func(ev pq.ListenerEventType, listenErr error) {
@@ -125,51 +180,58 @@ func streamDeploymentEvents(deploymentID string, w http.ResponseWriter, repo *De
 	var currID int64
 	events, err := repo.listEvents(deploymentID, 0)
 	if err != nil {
-		return
+		return err
 	}
 	for _, e := range events {
-		if err = sendDeploymentEvent(e); err != nil {
-			return
+		if err := sink.Send(e); err != nil {
+			return err
 		}
 		currID = e.ID
 	}
 
 	select {
 	case <-done:
-		return
+		return nil
 	case <-connected:
 	}
 
-	if err = sendKeepAlive(); err != nil {
-		return
+	keepAlive := func() error { return nil }
+	if s, ok := sink.(interface {
+		keepAlive() error
+	}); ok {
+		keepAlive = s.keepAlive
+	}
+
+	if err := keepAlive(); err != nil {
+		return err
 	}
 
-	closed := w.(http.CloseNotifier).CloseNotify()
 	for {
 		select {
 		case <-done:
-			return
+			return nil
 		case <-closed:
-			return
+			return nil
 		case <-time.After(30 * time.Second):
-			if err = sendKeepAlive(); err != nil {
-				return
+			if err := keepAlive(); err != nil {
+				return err
 			}
 		case n := <-listener.Notify:
 			id, err := strconv.ParseInt(n.Extra, 10, 64)
 			if err != nil {
-				return
+				return err
 			}
 			if id <= currID {
 				continue
 			}
 			e, err := repo.getEvent(id)
 			if err != nil {
-				return
+				return err
 			}
-			if err = sendDeploymentEvent(e); err != nil {
-				return
+			if err := sink.Send(e); err != nil {
+				return err
 			}
+			currID = id
 		}
 	}
 }
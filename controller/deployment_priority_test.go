@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+// TestDeploymentPriorityOrdering guards against deploymentPriority and
+// claimDeployment's ORDER BY disagreeing about which direction "runs
+// first" means. claimDeployment orders by priority ASC (lower claimed
+// first), so canary's priority must be numerically greater than
+// one-by-one's for canary to actually queue behind it as documented.
+func TestDeploymentPriorityOrdering(t *testing.T) {
+	oneByOne := deploymentPriority("one-by-one")
+	canary := deploymentPriority("canary")
+	if !(oneByOne < canary) {
+		t.Errorf("deploymentPriority(\"one-by-one\")=%d should be less than deploymentPriority(\"canary\")=%d, since claimDeployment claims the lowest priority first", oneByOne, canary)
+	}
+}
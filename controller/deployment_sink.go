@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/websocket"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// DeploymentEventSink delivers ct.DeploymentEvents to a single subscriber.
+// The deployment event listener fans out each event to every sink
+// registered for a deployment, calling each sink's Send in turn. The
+// webhook sink's Send returns once the delivery is recorded and POSTs in
+// the background, so a webhook with a hung server doesn't hold up the others.
+type DeploymentEventSink interface {
+	// Send delivers a single event. A non-nil error means the sink is
+	// considered dead and is dropped by whatever registered it.
+	Send(e *ct.DeploymentEvent) error
+	Close()
+}
+
+// sseSink streams events as server-sent events over an HTTP response
+// writer. This is the original (and still default) transport used by the
+// web dashboard.
+type sseSink struct {
+	w http.ResponseWriter
+}
+
+func newSSESink(w http.ResponseWriter) *sseSink {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	return &sseSink{w: w}
+}
+
+func (s *sseSink) Send(e *ct.DeploymentEvent) error {
+	if _, err := fmt.Fprintf(s.w, "id: %d\ndata: ", e.ID); err != nil {
+		return err
+	}
+	if err := json.NewEncoder(s.w).Encode(e); err != nil {
+		return err
+	}
+	if _, err := s.w.Write([]byte("\n")); err != nil {
+		return err
+	}
+	s.w.(http.Flusher).Flush()
+	return nil
+}
+
+// keepAlive writes an SSE comment line so intermediaries don't time out the
+// connection during quiet periods.
+func (s *sseSink) keepAlive() error {
+	if _, err := s.w.Write([]byte(":\n")); err != nil {
+		return err
+	}
+	s.w.(http.Flusher).Flush()
+	return nil
+}
+
+func (s *sseSink) Close() {}
+
+// wsSink streams events as JSON text frames over a WebSocket connection
+// negotiated via the standard `Upgrade: websocket` handshake.
+type wsSink struct {
+	conn *websocket.Conn
+}
+
+func newWSSink(conn *websocket.Conn) *wsSink {
+	return &wsSink{conn: conn}
+}
+
+func (s *wsSink) Send(e *ct.DeploymentEvent) error {
+	return websocket.JSON.Send(s.conn, e)
+}
+
+func (s *wsSink) Close() {
+	s.conn.Close()
+}
+
+// fanoutSink broadcasts each event to every sink in sinks. A sink that
+// returns an error is dropped from future sends rather than aborting the
+// whole fan-out, so one dead webhook can't stop delivery to the others.
+type fanoutSink struct {
+	sinks []DeploymentEventSink
+}
+
+func (s *fanoutSink) Send(e *ct.DeploymentEvent) error {
+	live := s.sinks[:0]
+	for _, sink := range s.sinks {
+		if err := sink.Send(e); err != nil {
+			sink.Close()
+			continue
+		}
+		live = append(live, sink)
+	}
+	s.sinks = live
+	if len(s.sinks) == 0 {
+		return fmt.Errorf("controller: all sinks in fan-out are dead")
+	}
+	return nil
+}
+
+func (s *fanoutSink) Close() {
+	for _, sink := range s.sinks {
+		sink.Close()
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// RegisterWebhookRoutes registers the app webhook subscription endpoint.
+func RegisterWebhookRoutes(repo *DeploymentRepo, r *httprouter.Router) {
+	r.POST("/apps/:app_id/webhooks", repo.AddWebhookHandler)
+}
+
+// AppWebhook is a per-app subscription that receives every
+// ct.DeploymentEvent for that app's deployments as a signed HTTP POST.
+type AppWebhook struct {
+	ID        string    `json:"id"`
+	AppID     string    `json:"app_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AddWebhook registers a new webhook for hook.AppID, generating an ID and
+// HMAC secret if they are not already set.
+func (r *DeploymentRepo) AddWebhook(hook *AppWebhook) error {
+	if hook.ID == "" {
+		hook.ID = random.UUID()
+	}
+	if hook.Secret == "" {
+		hook.Secret = random.Hex(32)
+	}
+	query := "INSERT INTO app_webhooks (webhook_id, app_id, url, secret) VALUES ($1, $2, $3, $4) RETURNING created_at"
+	return r.db.QueryRow(query, hook.ID, hook.AppID, hook.URL, hook.Secret).Scan(&hook.CreatedAt)
+}
+
+// AddWebhookHandler registers a webhook for the app named by the app_id
+// route param, so operators and API consumers have a way to actually
+// subscribe without reaching into the database.
+func (r *DeploymentRepo) AddWebhookHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	hook := &AppWebhook{AppID: ps.ByName("app_id")}
+	if err := json.NewDecoder(req.Body).Decode(hook); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	hook.AppID = ps.ByName("app_id")
+	if err := r.AddWebhook(hook); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, hook)
+}
+
+// webhooksForApp returns the webhooks registered for appID.
+func (r *DeploymentRepo) webhooksForApp(appID string) ([]*AppWebhook, error) {
+	rows, err := r.db.Query("SELECT webhook_id, app_id, url, secret, created_at FROM app_webhooks WHERE app_id = $1", appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []*AppWebhook
+	for rows.Next() {
+		hook := &AppWebhook{}
+		if err := rows.Scan(&hook.ID, &hook.AppID, &hook.URL, &hook.Secret, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+// getWebhook returns the webhook registered under id.
+func (r *DeploymentRepo) getWebhook(id string) (*AppWebhook, error) {
+	hook := &AppWebhook{}
+	row := r.db.QueryRow("SELECT webhook_id, app_id, url, secret, created_at FROM app_webhooks WHERE webhook_id = $1", id)
+	err := row.Scan(&hook.ID, &hook.AppID, &hook.URL, &hook.Secret, &hook.CreatedAt)
+	return hook, err
+}
+
+// resumePendingDeliveries re-delivers every deployment_event_deliveries row
+// that was recorded but never marked delivered, so a retry that was still
+// in flight when the controller last restarted picks back up instead of
+// silently going dark. It should be called once at startup.
+func (r *DeploymentRepo) resumePendingDeliveries() error {
+	rows, err := r.db.Query("SELECT delivery_id, webhook_id, event_id FROM deployment_event_deliveries WHERE delivered_at IS NULL")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type pendingDelivery struct {
+		deliveryID, webhookID string
+		eventID               int64
+	}
+	var pending []pendingDelivery
+	for rows.Next() {
+		var p pendingDelivery
+		if err := rows.Scan(&p.deliveryID, &p.webhookID, &p.eventID); err != nil {
+			return err
+		}
+		pending = append(pending, p)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range pending {
+		hook, err := r.getWebhook(p.webhookID)
+		if err != nil {
+			log.Printf("controller: failed to resume delivery %s: %s", p.deliveryID, err)
+			continue
+		}
+		event, err := r.getEvent(p.eventID)
+		if err != nil {
+			log.Printf("controller: failed to resume delivery %s: %s", p.deliveryID, err)
+			continue
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("controller: failed to resume delivery %s: %s", p.deliveryID, err)
+			continue
+		}
+		go newWebhookSink(r, hook).deliver(p.deliveryID, body)
+	}
+	return nil
+}
+
+// webhook delivery retry schedule. Each failed attempt is retried after the
+// corresponding backoff, for a total of len(webhookBackoff) attempts.
+var webhookBackoff = []time.Duration{
+	time.Second,
+	10 * time.Second,
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+}
+
+// webhookSink delivers events to hook.URL, recording each delivery in
+// deployment_event_deliveries until it succeeds so retries are at-least-once even across
+// controller restarts.
+type webhookSink struct {
+	repo *DeploymentRepo
+	hook *AppWebhook
+}
+
+func newWebhookSink(repo *DeploymentRepo, hook *AppWebhook) *webhookSink {
+	return &webhookSink{repo: repo, hook: hook}
+}
+
+func (s *webhookSink) Send(e *ct.DeploymentEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	deliveryID, err := s.repo.createDelivery(s.hook.ID, e.ID)
+	if err != nil {
+		return err
+	}
+
+	go s.deliver(deliveryID, body)
+	return nil
+}
+
+func (s *webhookSink) Close() {}
+
+// deliver POSTs body to the webhook URL, retrying with backoff on failure
+// and marking the delivery as done once it succeeds. If the retry schedule
+// is exhausted the delivery is left unmarked, so resumePendingDeliveries
+// picks it up again at the next startup.
+func (s *webhookSink) deliver(deliveryID string, body []byte) {
+	for attempt := 0; attempt < len(webhookBackoff); attempt++ {
+		if attempt > 0 {
+			time.Sleep(webhookBackoff[attempt-1])
+		}
+		if err := s.post(body); err != nil {
+			log.Printf("controller: webhook %s delivery %s attempt %d failed: %s", s.hook.ID, deliveryID, attempt+1, err)
+			continue
+		}
+		if err := s.repo.markDelivered(deliveryID); err != nil {
+			log.Printf("controller: webhook %s delivery %s: failed to mark delivered: %s", s.hook.ID, deliveryID, err)
+		}
+		return
+	}
+	log.Printf("controller: webhook %s delivery %s: giving up after %d attempts", s.hook.ID, deliveryID, len(webhookBackoff))
+}
+
+func (s *webhookSink) post(body []byte) error {
+	req, err := http.NewRequest("POST", s.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Flynn-Webhook-Signature", sign(s.hook.Secret, body))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// sign returns the hex-encoded HMAC-SHA256 of body using secret, so
+// receivers can verify a delivery genuinely came from this controller.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// createDelivery records that eventID is queued for delivery to webhookID,
+// returning the new delivery's ID.
+func (r *DeploymentRepo) createDelivery(webhookID string, eventID int64) (string, error) {
+	id := random.UUID()
+	query := "INSERT INTO deployment_event_deliveries (delivery_id, webhook_id, event_id) VALUES ($1, $2, $3)"
+	if _, err := r.db.Exec(query, id, webhookID, eventID); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// markDelivered records that deliveryID was successfully delivered.
+func (r *DeploymentRepo) markDelivered(deliveryID string) error {
+	_, err := r.db.Exec("UPDATE deployment_event_deliveries SET delivered_at = now() WHERE delivery_id = $1", deliveryID)
+	return err
+}
+
+// watchWebhooks starts a background fan-out of d's events to every webhook
+// registered for d.AppID, so webhook subscribers are delivered to without
+// needing to hold an SSE or WebSocket connection open for the deployment.
+// It is a no-op if the app has no webhooks registered.
+func (r *DeploymentRepo) watchWebhooks(d *ct.Deployment) {
+	hooks, err := r.webhooksForApp(d.AppID)
+	if err != nil {
+		log.Printf("controller: failed to load webhooks for app %s: %s", d.AppID, err)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	sinks := make([]DeploymentEventSink, len(hooks))
+	for i, hook := range hooks {
+		sinks[i] = newWebhookSink(r, hook)
+	}
+
+	go func() {
+		if err := runEventSink(d.ID, r, &fanoutSink{sinks: sinks}, nil); err != nil {
+			log.Printf("controller: webhook fan-out for deployment %s stopped: %s", d.ID, err)
+		}
+	}()
+}
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestSignIsDeterministicPerSecret(t *testing.T) {
+	body := []byte(`{"status":"complete"}`)
+
+	sig1 := sign("secret-a", body)
+	sig2 := sign("secret-a", body)
+	if sig1 != sig2 {
+		t.Errorf("sign is not deterministic: %s != %s", sig1, sig2)
+	}
+
+	if sig3 := sign("secret-b", body); sig3 == sig1 {
+		t.Errorf("sign produced the same signature for different secrets")
+	}
+}
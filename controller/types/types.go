@@ -0,0 +1,77 @@
+// Package ct holds the types shared between the controller and its
+// clients (the deployer, flynn-host, and the CLI).
+package ct
+
+import (
+	"time"
+
+	"github.com/flynn/flynn/host/resource"
+)
+
+// Deployment represents an in-progress or completed rollout from
+// OldReleaseID to NewReleaseID for AppID, executed by one of the
+// strategies in deployer/strategies according to Strategy.
+type Deployment struct {
+	ID           string `json:"id"`
+	AppID        string `json:"app_id"`
+	OldReleaseID string `json:"old_release_id"`
+	NewReleaseID string `json:"new_release_id"`
+	Strategy     string `json:"strategy"`
+
+	// Priority orders concurrent deployments in the worker's claim
+	// query; lower values are claimed first (see deploymentPriority and
+	// controller/deployer/worker.go's claimDeployment).
+	Priority int16 `json:"priority"`
+
+	// CanaryPercent, BakeDuration and SurgeBatch configure the
+	// "canary" strategy; they are ignored by other strategies.
+	CanaryPercent int           `json:"canary_percent,omitempty"`
+	BakeDuration  time.Duration `json:"bake_duration,omitempty"`
+	SurgeBatch    int           `json:"surge_batch,omitempty"`
+
+	// Resources are the per-process resource requests/limits the deployer
+	// applies to new-release jobs; see host/resource.Resources.SetDefaults
+	// for what's assumed when a Type is left unset.
+	Resources resource.Resources `json:"resources,omitempty"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	// StuckAt is set by claimDeployment when it finds and reclaims a
+	// deployment whose lease had expired without it finishing, meaning the
+	// worker previously running it died mid-run or its run returned an
+	// error. It is never cleared, so an operator can
+	// tell a deployment stalled and was retried even after it later
+	// finishes successfully.
+	StuckAt *time.Time `json:"stuck_at,omitempty"`
+}
+
+// DeploymentEvent records a single state transition of a deployment, such
+// as a job coming up or down, the canary batch becoming healthy, or a
+// strategy waiting for cluster capacity.
+type DeploymentEvent struct {
+	ID           int64     `json:"id"`
+	DeploymentID string    `json:"deployment_id"`
+	ReleaseID    string    `json:"release_id"`
+	JobType      string    `json:"job_type,omitempty"`
+	JobState     string    `json:"job_state,omitempty"`
+	Status       string    `json:"status"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Formation is the desired process counts for a release.
+type Formation struct {
+	AppID     string         `json:"app_id"`
+	ReleaseID string         `json:"release_id"`
+	Processes map[string]int `json:"processes"`
+}
+
+// JobEvent reports a single job's state transition, as streamed by
+// controller.Client.StreamJobEvents.
+type JobEvent struct {
+	JobID     string `json:"job_id"`
+	AppID     string `json:"app_id"`
+	ReleaseID string `json:"release_id"`
+	Type      string `json:"type"`
+	State     string `json:"state"`
+}
@@ -0,0 +1,240 @@
+package strategy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/deployer/types"
+)
+
+func init() {
+	Register("canary", canary)
+}
+
+// canary brings up d.CanaryPercent of the new release first, waits for it to
+// report healthy and bakes for d.BakeDuration before replacing the rest of
+// the old release in batches of d.SurgeBatch. If the canary batch never
+// becomes healthy, the new release is scaled back to zero and oldFormation
+// is restored.
+func canary(client *controller.Client, d *deployer.Deployment, events chan<- deployer.DeploymentEvent) error {
+	jobStream := make(chan *ct.JobEvent)
+	stream, err := client.StreamJobEvents(d.AppID, 0, jobStream)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	f, err := client.GetFormation(d.AppID, d.OldReleaseID)
+	if err != nil {
+		return err
+	}
+
+	oldFormation := f.Processes
+	newFormation := map[string]int{}
+
+	// oldFormation is scaled down in place by the surge loop below, so keep
+	// the old release's starting formation for rollback to restore
+	initialFormation := make(map[string]int, len(oldFormation))
+	for typ, n := range oldFormation {
+		initialFormation[typ] = n
+	}
+
+	canaryFormation := computeCanaryFormation(oldFormation, d.CanaryPercent)
+
+	// bring up the canary batch of the new release
+	for typ, n := range canaryFormation {
+		if n == 0 {
+			continue
+		}
+		if err := checkCancelled(d); err != nil {
+			return rollback(client, d, initialFormation, newFormation, err)
+		}
+		if err := waitForCapacity(client, d, typ, n, events); err != nil {
+			return rollback(client, d, initialFormation, newFormation, err)
+		}
+		newFormation[typ] = n
+		if err := client.PutFormation(&ct.Formation{
+			AppID:     d.AppID,
+			ReleaseID: d.NewReleaseID,
+			Processes: newFormation,
+		}); err != nil {
+			releaseCapacity(client, d.NewReleaseID, typ, n)
+			return err
+		}
+		if _, _, err := waitForJobEvents(jobStream, jobEvents{typ: {"up": n}}); err != nil {
+			return rollback(client, d, initialFormation, newFormation, err)
+		}
+	}
+
+	events <- deployer.DeploymentEvent{
+		DeploymentID: d.ID,
+		ReleaseID:    d.NewReleaseID,
+		Status:       "canary-healthy",
+	}
+
+	if err := checkCancelled(d); err != nil {
+		return rollback(client, d, initialFormation, newFormation, err)
+	}
+
+	if d.BakeDuration > 0 {
+		if err := sleepCancellable(d, d.BakeDuration); err != nil {
+			return rollback(client, d, initialFormation, newFormation, err)
+		}
+	}
+
+	surgeBatch := d.SurgeBatch
+	if surgeBatch < 1 {
+		surgeBatch = 1
+	}
+
+	// replace the old-release processes in surge batches. The canary batch
+	// brought up above already counts toward newFormation, so only
+	// num-canaryFormation[typ] more new instances are started here, each
+	// batch stopping as many old ones; the canaryFormation[typ] old
+	// instances still running after that are stopped once the loop is done.
+	for typ, num := range oldFormation {
+		remaining := num - canaryFormation[typ]
+		for remaining > 0 {
+			if err := checkCancelled(d); err != nil {
+				return rollback(client, d, initialFormation, newFormation, err)
+			}
+
+			batch := nextBatch(surgeBatch, remaining)
+
+			if err := waitForCapacity(client, d, typ, batch, events); err != nil {
+				return rollback(client, d, initialFormation, newFormation, err)
+			}
+			newFormation[typ] += batch
+			if err := client.PutFormation(&ct.Formation{
+				AppID:     d.AppID,
+				ReleaseID: d.NewReleaseID,
+				Processes: newFormation,
+			}); err != nil {
+				releaseCapacity(client, d.NewReleaseID, typ, batch)
+				return err
+			}
+			if _, _, err := waitForJobEvents(jobStream, jobEvents{typ: {"up": batch}}); err != nil {
+				return rollback(client, d, initialFormation, newFormation, err)
+			}
+
+			if err := checkCancelled(d); err != nil {
+				return rollback(client, d, initialFormation, newFormation, err)
+			}
+
+			oldFormation[typ] -= batch
+			if err := client.PutFormation(&ct.Formation{
+				AppID:     d.AppID,
+				ReleaseID: d.OldReleaseID,
+				Processes: oldFormation,
+			}); err != nil {
+				return err
+			}
+			if _, _, err := waitForJobEvents(jobStream, jobEvents{typ: {"down": batch}}); err != nil {
+				return rollback(client, d, initialFormation, newFormation, err)
+			}
+
+			// the old-release batch just stopped, so whatever capacity
+			// it held (if any -- it may predate capacity tracking) is
+			// free again
+			releaseCapacity(client, d.OldReleaseID, typ, batch)
+
+			remaining -= batch
+		}
+
+		// the canary batch ran alongside the old release rather than in
+		// place of any of it, so stop that many old instances now
+		if n := canaryFormation[typ]; n > 0 {
+			oldFormation[typ] -= n
+			if err := client.PutFormation(&ct.Formation{
+				AppID:     d.AppID,
+				ReleaseID: d.OldReleaseID,
+				Processes: oldFormation,
+			}); err != nil {
+				return err
+			}
+			if _, _, err := waitForJobEvents(jobStream, jobEvents{typ: {"down": n}}); err != nil {
+				return rollback(client, d, initialFormation, newFormation, err)
+			}
+			releaseCapacity(client, d.OldReleaseID, typ, n)
+		}
+	}
+	return nil
+}
+
+// bakeCheckInterval bounds how long sleepCancellable sleeps at a time, so a
+// multi-minute bake doesn't delay noticing an operator's cancel request.
+const bakeCheckInterval = 5 * time.Second
+
+// sleepCancellable sleeps for dur, checking d for cancellation every
+// bakeCheckInterval so the wait can be interrupted promptly instead of
+// only at its end.
+func sleepCancellable(d *deployer.Deployment, dur time.Duration) error {
+	deadline := time.Now().Add(dur)
+	for {
+		if err := checkCancelled(d); err != nil {
+			return err
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return nil
+		}
+		if remaining > bakeCheckInterval {
+			remaining = bakeCheckInterval
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// computeCanaryFormation returns the subset of oldFormation to bring up as
+// the canary batch, using canaryPercent (defaulting to 10 if unset) of each
+// process type, rounded up to at least 1 where the old formation is non-zero.
+func computeCanaryFormation(oldFormation map[string]int, canaryPercent int) map[string]int {
+	if canaryPercent <= 0 {
+		canaryPercent = 10
+	}
+	canaryFormation := make(map[string]int, len(oldFormation))
+	for typ, num := range oldFormation {
+		n := num * canaryPercent / 100
+		if n < 1 && num > 0 {
+			n = 1
+		}
+		canaryFormation[typ] = n
+	}
+	return canaryFormation
+}
+
+// nextBatch returns the size of the next surge batch, capped at remaining.
+func nextBatch(surgeBatch, remaining int) int {
+	if surgeBatch > remaining {
+		return remaining
+	}
+	return surgeBatch
+}
+
+// rollback scales the new release back to zero, releasing whatever
+// capacity newFormation had reserved for it, and restores oldFormation,
+// returning cause wrapped to explain the deployment was rolled back.
+func rollback(client *controller.Client, d *deployer.Deployment, oldFormation, newFormation map[string]int, cause error) error {
+	zero := make(map[string]int, len(oldFormation))
+	for typ := range oldFormation {
+		zero[typ] = 0
+	}
+	client.PutFormation(&ct.Formation{
+		AppID:     d.AppID,
+		ReleaseID: d.NewReleaseID,
+		Processes: zero,
+	})
+	client.PutFormation(&ct.Formation{
+		AppID:     d.AppID,
+		ReleaseID: d.OldReleaseID,
+		Processes: oldFormation,
+	})
+	for typ, n := range newFormation {
+		if n > 0 {
+			releaseCapacity(client, d.NewReleaseID, typ, n)
+		}
+	}
+	return fmt.Errorf("deployer: canary deployment rolled back: %s", cause)
+}
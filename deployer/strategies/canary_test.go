@@ -0,0 +1,64 @@
+package strategy
+
+import "testing"
+
+func TestComputeCanaryFormation(t *testing.T) {
+	tests := []struct {
+		old     map[string]int
+		percent int
+		want    map[string]int
+	}{
+		{map[string]int{"web": 10}, 10, map[string]int{"web": 1}},
+		{map[string]int{"web": 10}, 0, map[string]int{"web": 1}}, // defaults to 10%
+		{map[string]int{"web": 2}, 10, map[string]int{"web": 1}}, // rounds up to at least 1
+		{map[string]int{"web": 0}, 50, map[string]int{"web": 0}},
+		{map[string]int{"web": 20}, 50, map[string]int{"web": 10}},
+	}
+	for _, test := range tests {
+		got := computeCanaryFormation(test.old, test.percent)
+		for typ, want := range test.want {
+			if got[typ] != want {
+				t.Errorf("computeCanaryFormation(%v, %d)[%q] = %d, want %d", test.old, test.percent, typ, got[typ], want)
+			}
+		}
+	}
+}
+
+func TestNextBatch(t *testing.T) {
+	tests := []struct {
+		surgeBatch, remaining, want int
+	}{
+		{3, 10, 3},
+		{3, 2, 2},
+		{3, 3, 3},
+	}
+	for _, test := range tests {
+		got := nextBatch(test.surgeBatch, test.remaining)
+		if got != test.want {
+			t.Errorf("nextBatch(%d, %d) = %d, want %d", test.surgeBatch, test.remaining, got, test.want)
+		}
+	}
+}
+
+// TestSurgeLoopFinalFormationMatchesOld guards against the surge loop
+// over- or under-counting how many old-release instances still need
+// replacing: the canary batch brought up before the surge loop already
+// counts toward the new release's total, so the surge loop must only
+// replace num-canaryFormation[typ] more, leaving the new release at
+// exactly the old formation's size (not canaryFormation[typ]+num).
+func TestSurgeLoopFinalFormationMatchesOld(t *testing.T) {
+	oldFormation := map[string]int{"web": 10}
+	canaryFormation := computeCanaryFormation(oldFormation, 10)
+	surgeBatch := 3
+
+	newTotal := canaryFormation["web"]
+	remaining := oldFormation["web"] - canaryFormation["web"]
+	for remaining > 0 {
+		batch := nextBatch(surgeBatch, remaining)
+		newTotal += batch
+		remaining -= batch
+	}
+	if newTotal != oldFormation["web"] {
+		t.Errorf("surge loop left new formation at %d, want %d (canary batch was %d)", newTotal, oldFormation["web"], canaryFormation["web"])
+	}
+}
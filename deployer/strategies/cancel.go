@@ -0,0 +1,21 @@
+package strategy
+
+import (
+	"errors"
+
+	"github.com/flynn/flynn/deployer/types"
+)
+
+// errCancelled is returned by a strategy when the worker running it detects
+// the deployment was cancelled (see d.Cancelled) mid-run.
+var errCancelled = errors.New("strategy: deployment cancelled")
+
+// checkCancelled returns errCancelled if d has been cancelled. Strategies
+// call it between PutFormation calls so an operator-requested cancellation
+// is noticed promptly instead of only at the end of the deployment.
+func checkCancelled(d *deployer.Deployment) error {
+	if d.Cancelled != nil && d.Cancelled() {
+		return errCancelled
+	}
+	return nil
+}
@@ -6,6 +6,9 @@ import (
 	"github.com/flynn/flynn/deployer/types"
 )
 
+// oneByOne replaces old-release processes with new-release processes one
+// at a time, waiting for each new process to come up before stopping the
+// corresponding old one.
 func oneByOne(client *controller.Client, d *deployer.Deployment, events chan<- deployer.DeploymentEvent) error {
 	jobStream := make(chan *ct.JobEvent)
 	stream, err := client.StreamJobEvents(d.AppID, 0, jobStream)
@@ -24,6 +27,12 @@ func oneByOne(client *controller.Client, d *deployer.Deployment, events chan<- d
 
 	for typ, num := range f.Processes {
 		for i := 0; i < num; i++ {
+			if err := checkCancelled(d); err != nil {
+				return err
+			}
+			if err := waitForCapacity(client, d, typ, 1, events); err != nil {
+				return err
+			}
 			// start one process
 			newFormation[typ]++
 			if err := client.PutFormation(&ct.Formation{
@@ -31,11 +40,18 @@ func oneByOne(client *controller.Client, d *deployer.Deployment, events chan<- d
 				ReleaseID: d.NewReleaseID,
 				Processes: newFormation,
 			}); err != nil {
+				// the process was never actually started, so the
+				// capacity reserved for it is free again
+				releaseCapacity(client, d.NewReleaseID, typ, 1)
 				return err
 			}
 			if _, _, err := waitForJobEvents(jobStream, jobEvents{typ: {"up": 1}}); err != nil {
 				return err
 			}
+
+			if err := checkCancelled(d); err != nil {
+				return err
+			}
 			// stop one process
 			oldFormation[typ]--
 			if err := client.PutFormation(&ct.Formation{
@@ -48,6 +64,11 @@ func oneByOne(client *controller.Client, d *deployer.Deployment, events chan<- d
 			if _, _, err := waitForJobEvents(jobStream, jobEvents{typ: {"down": 1}}); err != nil {
 				return err
 			}
+
+			// the old-release process just stopped, so whatever
+			// capacity it held (if any -- it may predate capacity
+			// tracking) is free again
+			releaseCapacity(client, d.OldReleaseID, typ, 1)
 		}
 	}
 	return nil
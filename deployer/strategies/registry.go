@@ -0,0 +1,34 @@
+package strategy
+
+import (
+	"fmt"
+
+	"github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/deployer/types"
+)
+
+// Func performs a deployment using a particular strategy, emitting progress
+// as deployer.DeploymentEvents on events.
+type Func func(client *controller.Client, d *deployer.Deployment, events chan<- deployer.DeploymentEvent) error
+
+var registry = make(map[string]Func)
+
+// Register adds a strategy to the registry under name, making it available
+// to Get (and so to anything that dispatches deployments by
+// ct.Deployment.Strategy) without needing to edit the dispatcher.
+func Register(name string, fn Func) {
+	registry[name] = fn
+}
+
+// Get looks up a registered strategy by name.
+func Get(name string) (Func, error) {
+	fn, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("strategy: unknown strategy %q", name)
+	}
+	return fn, nil
+}
+
+func init() {
+	Register("one-by-one", oneByOne)
+}
@@ -0,0 +1,68 @@
+package strategy
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/deployer/types"
+	"github.com/flynn/flynn/host/resource"
+)
+
+// resourceWaitTimeout bounds how long a strategy will block waiting for the
+// cluster to free up capacity before giving up on the deployment.
+const resourceWaitTimeout = 10 * time.Minute
+
+// resourceWaitInterval is how often capacity is rechecked while waiting.
+const resourceWaitInterval = 5 * time.Second
+
+// waitForCapacity blocks until the cluster has enough free capacity to run n
+// additional processes of typ from d.NewReleaseID, applying d.Resources'
+// defaults first, then reserves that capacity against (d.NewReleaseID,
+// typ). The reservation stays in effect for as long as those processes
+// keep running -- including past the end of this deployment, once
+// d.NewReleaseID becomes the "old" release a later deployment replaces in
+// turn -- and is only released by a releaseCapacity call made against the
+// same release and type once they actually stop. It emits a single
+// resource-wait DeploymentEvent if it has to wait, and gives up with an
+// error after resourceWaitTimeout.
+func waitForCapacity(client *controller.Client, d *deployer.Deployment, typ string, n int, events chan<- deployer.DeploymentEvent) error {
+	var res resource.Resources = d.Resources
+	res.SetDefaults()
+
+	deadline := time.Now().Add(resourceWaitTimeout)
+	waiting := false
+	for {
+		ok, err := client.HasCapacity(d.NewReleaseID, typ, n, res)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if !waiting {
+			events <- deployer.DeploymentEvent{
+				DeploymentID: d.ID,
+				ReleaseID:    d.NewReleaseID,
+				JobType:      typ,
+				Status:       "resource-wait",
+			}
+			waiting = true
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("strategy: timed out waiting for capacity to run %d %s process(es)", n, typ)
+		}
+		time.Sleep(resourceWaitInterval)
+	}
+}
+
+// releaseCapacity releases n instances of typ previously reserved against
+// releaseID by waitForCapacity, once they've actually stopped. A failed
+// release only leaks unused cluster capacity, so it's logged rather than
+// failing an otherwise-successful deployment step.
+func releaseCapacity(client *controller.Client, releaseID, typ string, n int) {
+	if err := client.ReleaseCapacity(releaseID, typ, n); err != nil {
+		log.Printf("strategy: failed to release %d %s capacity reservation(s) for release %s: %s", n, typ, releaseID, err)
+	}
+}
@@ -0,0 +1,45 @@
+// Package deployer holds the types used by deployer/strategies to drive a
+// single deployment, assembled from the corresponding ct.Deployment by
+// whatever dispatches deployments (see controller/deployer).
+package deployer
+
+import (
+	"time"
+
+	"github.com/flynn/flynn/host/resource"
+)
+
+// Deployment is the subset of a deployment's state a strategy needs in
+// order to run.
+type Deployment struct {
+	ID           string
+	AppID        string
+	OldReleaseID string
+	NewReleaseID string
+
+	// CanaryPercent, BakeDuration and SurgeBatch mirror the same fields
+	// on ct.Deployment; only the "canary" strategy reads them.
+	CanaryPercent int
+	BakeDuration  time.Duration
+	SurgeBatch    int
+
+	// Resources are the per-process resource requests/limits applied to
+	// new-release jobs; waitForCapacity (deployer/strategies/resources.go)
+	// checks them against cluster capacity before scaling up.
+	Resources resource.Resources
+
+	// Cancelled reports whether an operator has requested this
+	// deployment be aborted; strategies poll it between PutFormation
+	// calls (see deployer/strategies/cancel.go). It is nil-safe: a nil
+	// Cancelled means cancellation was never wired up, so it's treated
+	// as never cancelled.
+	Cancelled func() bool
+}
+
+// DeploymentEvent is emitted by a strategy to report progress.
+type DeploymentEvent struct {
+	DeploymentID string
+	ReleaseID    string
+	JobType      string
+	Status       string
+}
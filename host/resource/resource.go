@@ -0,0 +1,45 @@
+// Package resource describes per-process resource requests and limits
+// honored by the scheduler and deployer when placing jobs.
+package resource
+
+// Type identifies a kind of resource a job can request or be limited by.
+type Type string
+
+const (
+	TypeMemory Type = "memory"
+	TypeCPU    Type = "cpu"
+	TypeMaxFD  Type = "max_fd"
+)
+
+// MB is one megabyte (1024*1024 bytes); memory specs are expressed in bytes.
+const MB int64 = 1024 * 1024
+
+// Spec is the requested and hard limit for a single resource Type.
+// Request is what the scheduler reserves when checking capacity; Limit is
+// enforced on the running job (e.g. via cgroups).
+type Spec struct {
+	Request int64 `json:"request"`
+	Limit   int64 `json:"limit"`
+}
+
+// defaults are applied by SetDefaults for any Type not already set.
+var defaults = map[Type]Spec{
+	TypeMemory: {Request: 256 * MB, Limit: 256 * MB},
+	TypeCPU:    {Request: 1, Limit: 1},
+	TypeMaxFD:  {Request: 1024, Limit: 1024},
+}
+
+// Resources holds the per-Type resource specs requested for a single job.
+type Resources map[Type]Spec
+
+// SetDefaults fills in defaults for any Type not already present in r.
+func (r *Resources) SetDefaults() {
+	if *r == nil {
+		*r = make(Resources, len(defaults))
+	}
+	for typ, spec := range defaults {
+		if _, ok := (*r)[typ]; !ok {
+			(*r)[typ] = spec
+		}
+	}
+}
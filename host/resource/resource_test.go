@@ -0,0 +1,27 @@
+package resource
+
+import "testing"
+
+func TestSetDefaultsNilMap(t *testing.T) {
+	var r Resources
+	r.SetDefaults()
+	if len(r) != len(defaults) {
+		t.Fatalf("SetDefaults on nil map produced %d entries, want %d", len(r), len(defaults))
+	}
+	for typ, spec := range defaults {
+		if r[typ] != spec {
+			t.Errorf("r[%q] = %+v, want %+v", typ, r[typ], spec)
+		}
+	}
+}
+
+func TestSetDefaultsPreservesExisting(t *testing.T) {
+	r := Resources{TypeMemory: {Request: 42, Limit: 42}}
+	r.SetDefaults()
+	if r[TypeMemory] != (Spec{Request: 42, Limit: 42}) {
+		t.Errorf("SetDefaults overwrote an explicitly set value: %+v", r[TypeMemory])
+	}
+	if _, ok := r[TypeCPU]; !ok {
+		t.Errorf("SetDefaults did not fill in TypeCPU")
+	}
+}
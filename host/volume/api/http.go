@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
@@ -26,6 +27,8 @@ func RegisterRoutes(api *HttpAPI, r *httprouter.Router) {
 	r.POST("/volume/provider", api.CreateProvider)
 	r.POST("/volume/provider/:provider_id/newVolume", api.Create)
 	r.PUT("/volume/instances/:id/snapshot", api.Snapshot)
+	r.POST("/volume/instances/:id/send", api.Send)
+	r.POST("/volume/provider/:provider_id/receive", api.Receive)
 	r.GET("/volume/instances/:id/inspect", api.Inspect)
 }
 
@@ -80,10 +83,28 @@ func (api *HttpAPI) CreateProvider(w http.ResponseWriter, r *http.Request, ps ht
 	httphelper.JSON(w, 200, pspec)
 }
 
+// createVolumeParams is the optional JSON body accepted by Create, letting
+// callers request a size quota and IOPS cap for the new volume.
+type createVolumeParams struct {
+	Size uint64 `json:"size,omitempty"`
+	IOPS uint64 `json:"iops,omitempty"`
+}
+
 func (api *HttpAPI) Create(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	providerID := ps.ByName("provider_id")
 
-	vol, err := api.vman.NewVolumeFromProvider(providerID)
+	var params createVolumeParams
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+	}
+
+	vol, err := api.vman.NewVolumeFromProvider(providerID, &volume.CreateParams{
+		Size: params.Size,
+		IOPS: params.IOPS,
+	})
 	if err == volume.NoSuchProvider {
 		httphelper.Error(w, httphelper.JSONError{
 			Code:    httphelper.ObjectNotFoundError,
@@ -91,6 +112,10 @@ func (api *HttpAPI) Create(w http.ResponseWriter, r *http.Request, ps httprouter
 		})
 		return
 	}
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
 
 	httphelper.JSON(w, 200, vol.Info())
 }
@@ -109,6 +134,69 @@ func (api *HttpAPI) Inspect(w http.ResponseWriter, r *http.Request, ps httproute
 	httphelper.JSON(w, 200, vol.Info())
 }
 
+// Snapshot takes a zfs snapshot of the volume identified by id, registers
+// the snapshot as a new volume in vman and returns its Info().
 func (api *HttpAPI) Snapshot(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	// TODO
+	volumeID := ps.ByName("id")
+	vol := api.vman.GetVolume(volumeID)
+	if vol == nil {
+		httphelper.Error(w, httphelper.JSONError{
+			Code:    httphelper.ObjectNotFoundError,
+			Message: fmt.Sprintf("No volume by id %q", volumeID),
+		})
+		return
+	}
+
+	snap, err := api.vman.CreateSnapshot(volumeID)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	httphelper.JSON(w, 200, snap.Info())
+}
+
+// Send streams an incremental zfs send of the snapshot identified by id to
+// the client, using HTTP chunked transfer encoding. The optional
+// "haveSnapshot" query parameter names a snapshot the receiving side already
+// has, so only the delta since it is sent; without it a full send is made.
+func (api *HttpAPI) Send(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	volumeID := ps.ByName("id")
+	vol := api.vman.GetVolume(volumeID)
+	if vol == nil {
+		httphelper.Error(w, httphelper.JSONError{
+			Code:    httphelper.ObjectNotFoundError,
+			Message: fmt.Sprintf("No volume by id %q", volumeID),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(200)
+	if err := api.vman.SendSnapshot(volumeID, r.URL.Query().Get("haveSnapshot"), w); err != nil {
+		log.Printf("host: error sending snapshot %s: %s", volumeID, err)
+	}
+}
+
+// Receive pipes the request body into `zfs receive` against providerID,
+// registering the materialized dataset as a local volume and returning its
+// Info(). This is the counterpart to Send, used to migrate volumes between
+// hosts.
+func (api *HttpAPI) Receive(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	providerID := ps.ByName("provider_id")
+
+	vol, err := api.vman.ReceiveSnapshot(providerID, r.Body)
+	if err == volume.NoSuchProvider {
+		httphelper.Error(w, httphelper.JSONError{
+			Code:    httphelper.ObjectNotFoundError,
+			Message: fmt.Sprintf("No volume provider by id %q", providerID),
+		})
+		return
+	}
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+
+	httphelper.JSON(w, 200, vol.Info())
 }
@@ -0,0 +1,191 @@
+// Package volume manages persistent storage volumes on a host, backed by
+// pluggable providers (see host/volume/zfs).
+package volume
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ProviderAlreadyExists is returned by Manager.AddProvider when the given
+// id is already registered.
+var ProviderAlreadyExists = errors.New("volume: provider already exists")
+
+// NoSuchProvider is returned when a provider id has no registered provider.
+var NoSuchProvider = errors.New("volume: no such provider")
+
+// NoSuchVolume is returned when a volume id has no registered volume.
+var NoSuchVolume = errors.New("volume: no such volume")
+
+// ProviderSpec describes a provider to create, as posted to
+// POST /volume/provider.
+type ProviderSpec struct {
+	ID     string          `json:"id"`
+	Kind   string          `json:"kind"`
+	Config json.RawMessage `json:"config"`
+}
+
+// CreateParams customizes a volume created via NewVolumeFromProvider,
+// letting callers request a size quota and IOPS cap enforced by the
+// underlying provider.
+type CreateParams struct {
+	Size uint64
+	IOPS uint64
+}
+
+// Info describes a volume's identity and backing provider for API
+// responses.
+type Info struct {
+	ID         string `json:"id"`
+	ProviderID string `json:"provider_id"`
+}
+
+// Volume is a single unit of persistent storage managed by a Provider.
+type Volume interface {
+	Info() *Info
+}
+
+// Provider creates and manages volumes of a particular backing
+// implementation (e.g. zfs).
+type Provider interface {
+	NewVolume(params *CreateParams) (Volume, error)
+
+	// CreateSnapshot takes a point-in-time snapshot of vol.
+	CreateSnapshot(vol Volume) (Volume, error)
+
+	// SendSnapshot streams vol (which must be a snapshot) to w. If
+	// haveSnapshot is non-nil it is a snapshot the receiving side already
+	// has, so only the delta since it is sent.
+	SendSnapshot(vol, haveSnapshot Volume, w io.Writer) error
+
+	// ReceiveSnapshot materializes a volume from r, as produced by a
+	// peer's SendSnapshot.
+	ReceiveSnapshot(r io.Reader) (Volume, error)
+}
+
+// Manager tracks the volume providers and volumes registered on a host.
+type Manager struct {
+	mtx       sync.Mutex
+	providers map[string]Provider
+	volumes   map[string]Volume
+}
+
+// NewManager returns an empty Manager.
+func NewManager() *Manager {
+	return &Manager{
+		providers: make(map[string]Provider),
+		volumes:   make(map[string]Volume),
+	}
+}
+
+// AddProvider registers p under id.
+func (m *Manager) AddProvider(id string, p Provider) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.providers[id]; ok {
+		return ProviderAlreadyExists
+	}
+	m.providers[id] = p
+	return nil
+}
+
+func (m *Manager) provider(id string) (Provider, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	p, ok := m.providers[id]
+	if !ok {
+		return nil, NoSuchProvider
+	}
+	return p, nil
+}
+
+func (m *Manager) register(providerID string, vol Volume) Volume {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	info := vol.Info()
+	info.ProviderID = providerID
+	m.volumes[info.ID] = vol
+	return vol
+}
+
+// NewVolumeFromProvider creates a new volume via the provider registered
+// under providerID, applying params (which may be nil).
+func (m *Manager) NewVolumeFromProvider(providerID string, params *CreateParams) (Volume, error) {
+	p, err := m.provider(providerID)
+	if err != nil {
+		return nil, err
+	}
+	vol, err := p.NewVolume(params)
+	if err != nil {
+		return nil, err
+	}
+	return m.register(providerID, vol), nil
+}
+
+// GetVolume returns the volume registered under id, or nil if there is none.
+func (m *Manager) GetVolume(id string) Volume {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.volumes[id]
+}
+
+// CreateSnapshot takes a point-in-time snapshot of volumeID via its
+// provider, registers the snapshot as a new volume and returns it.
+func (m *Manager) CreateSnapshot(volumeID string) (Volume, error) {
+	vol := m.GetVolume(volumeID)
+	if vol == nil {
+		return nil, NoSuchVolume
+	}
+	p, err := m.provider(vol.Info().ProviderID)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := p.CreateSnapshot(vol)
+	if err != nil {
+		return nil, err
+	}
+	return m.register(vol.Info().ProviderID, snap), nil
+}
+
+// SendSnapshot streams volumeID (which must be a snapshot) to w via its
+// provider. If haveSnapshotID is non-empty it names a volume the receiving
+// side already has (as returned by CreateSnapshot), so
+// only the delta since it is sent; it must be resolved to the registered
+// Volume here rather than passed through as a bare id, since providers
+// identify a volume by more than its id (e.g. zfs needs its dataset path).
+func (m *Manager) SendSnapshot(volumeID, haveSnapshotID string, w io.Writer) error {
+	vol := m.GetVolume(volumeID)
+	if vol == nil {
+		return NoSuchVolume
+	}
+	var haveSnapshot Volume
+	if haveSnapshotID != "" {
+		haveSnapshot = m.GetVolume(haveSnapshotID)
+		if haveSnapshot == nil {
+			return NoSuchVolume
+		}
+	}
+	p, err := m.provider(vol.Info().ProviderID)
+	if err != nil {
+		return err
+	}
+	return p.SendSnapshot(vol, haveSnapshot, w)
+}
+
+// ReceiveSnapshot materializes a volume from r (as produced by a peer's
+// SendSnapshot) using providerID, registers and returns the resulting
+// volume. This is the counterpart to SendSnapshot, used to migrate volumes
+// between hosts.
+func (m *Manager) ReceiveSnapshot(providerID string, r io.Reader) (Volume, error) {
+	p, err := m.provider(providerID)
+	if err != nil {
+		return nil, err
+	}
+	vol, err := p.ReceiveSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+	return m.register(providerID, vol), nil
+}
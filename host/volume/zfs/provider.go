@@ -0,0 +1,130 @@
+// Package zfs implements a host/volume.Provider backed by ZFS datasets.
+package zfs
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+
+	"github.com/flynn/flynn/host/volume"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// ProviderConfig configures a zfs-backed Provider: which dataset new
+// volumes are created under, and the quota/refquota (in bytes) applied to
+// each one so volumes created via the HTTP API participate in the same
+// resource accounting as job resource limits.
+type ProviderConfig struct {
+	Dataset  string `json:"dataset"`
+	Quota    uint64 `json:"quota,omitempty"`
+	RefQuota uint64 `json:"refquota,omitempty"`
+}
+
+// Provider creates and manages volumes as ZFS datasets under config.Dataset.
+type Provider struct {
+	config *ProviderConfig
+}
+
+// NewProvider returns a Provider backed by config.
+func NewProvider(config *ProviderConfig) (*Provider, error) {
+	if config.Dataset == "" {
+		return nil, fmt.Errorf("zfs: dataset must not be blank")
+	}
+	return &Provider{config: config}, nil
+}
+
+type vol struct {
+	info    *volume.Info
+	dataset string
+}
+
+func (v *vol) Info() *volume.Info { return v.info }
+
+func (p *Provider) dataset(id string) string {
+	return p.config.Dataset + "/" + id
+}
+
+// NewVolume creates a new dataset, applying params' size quota and IOPS cap
+// as the dataset's quota and refquota properties (falling back to the
+// provider's configured defaults when params is nil or a field is zero).
+func (p *Provider) NewVolume(params *volume.CreateParams) (volume.Volume, error) {
+	id := random.UUID()
+	ds := p.dataset(id)
+
+	quota, refQuota := p.config.Quota, p.config.RefQuota
+	if params != nil {
+		if params.Size > 0 {
+			quota = params.Size
+		}
+		if params.IOPS > 0 {
+			refQuota = params.IOPS
+		}
+	}
+
+	args := []string{"create"}
+	if quota > 0 {
+		args = append(args, "-o", fmt.Sprintf("quota=%d", quota))
+	}
+	if refQuota > 0 {
+		args = append(args, "-o", fmt.Sprintf("refquota=%d", refQuota))
+	}
+	args = append(args, ds)
+
+	if out, err := exec.Command("zfs", args...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("zfs: failed to create dataset %s: %s: %s", ds, err, out)
+	}
+	return &vol{info: &volume.Info{ID: id}, dataset: ds}, nil
+}
+
+// CreateSnapshot takes a zfs snapshot of vol's dataset, registering it
+// under a new volume id.
+func (p *Provider) CreateSnapshot(v volume.Volume) (volume.Volume, error) {
+	zv := v.(*vol)
+	id := random.UUID()
+	snapshot := zv.dataset + "@" + id
+	if out, err := exec.Command("zfs", "snapshot", snapshot).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("zfs: failed to snapshot %s: %s: %s", zv.dataset, err, out)
+	}
+	return &vol{info: &volume.Info{ID: id}, dataset: snapshot}, nil
+}
+
+// sendArgs builds the argument list for a `zfs send` of dataset, adding an
+// -i incremental flag against haveDataset when it's non-empty.
+func sendArgs(dataset, haveDataset string) []string {
+	args := []string{"send"}
+	if haveDataset != "" {
+		args = append(args, "-i", haveDataset)
+	}
+	return append(args, dataset)
+}
+
+// SendSnapshot streams a `zfs send` of vol's dataset (which must be a
+// snapshot) to w. If haveSnapshot is non-nil, only the incremental delta
+// since that snapshot's dataset is sent.
+func (p *Provider) SendSnapshot(v, haveSnapshot volume.Volume, w io.Writer) error {
+	zv := v.(*vol)
+	var haveDataset string
+	if haveSnapshot != nil {
+		haveDataset = haveSnapshot.(*vol).dataset
+	}
+	cmd := exec.Command("zfs", sendArgs(zv.dataset, haveDataset)...)
+	cmd.Stdout = w
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("zfs: failed to send %s: %s", zv.dataset, err)
+	}
+	return nil
+}
+
+// ReceiveSnapshot pipes r into `zfs receive`, materializing it as a new
+// local dataset and registering it under a new volume id. This is the
+// counterpart to SendSnapshot, used to migrate volumes between hosts.
+func (p *Provider) ReceiveSnapshot(r io.Reader) (volume.Volume, error) {
+	id := random.UUID()
+	ds := p.dataset(id)
+	cmd := exec.Command("zfs", "receive", ds)
+	cmd.Stdin = r
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("zfs: failed to receive into dataset %s: %s: %s", ds, err, out)
+	}
+	return &vol{info: &volume.Info{ID: id}, dataset: ds}, nil
+}
@@ -0,0 +1,31 @@
+package zfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProviderDataset(t *testing.T) {
+	p := &Provider{config: &ProviderConfig{Dataset: "tank/flynn"}}
+	got := p.dataset("abc123")
+	want := "tank/flynn/abc123"
+	if got != want {
+		t.Errorf("dataset(%q) = %q, want %q", "abc123", got, want)
+	}
+}
+
+func TestSendArgsFull(t *testing.T) {
+	got := sendArgs("tank/flynn/abc123@snap1", "")
+	want := []string{"send", "tank/flynn/abc123@snap1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sendArgs = %v, want %v", got, want)
+	}
+}
+
+func TestSendArgsIncremental(t *testing.T) {
+	got := sendArgs("tank/flynn/abc123@snap2", "tank/flynn/abc123@snap1")
+	want := []string{"send", "-i", "tank/flynn/abc123@snap1", "tank/flynn/abc123@snap2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sendArgs = %v, want %v", got, want)
+	}
+}